@@ -2,17 +2,25 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"golang.org/x/tools/go/vcs"
 
@@ -34,6 +42,343 @@ type LockedProject struct {
 	Packages []string `toml:"packages"`
 }
 
+// GoSumEntry represents one module zip entry parsed out of a go.sum file.
+// The "/go.mod" hash lines (which only cover the module's go.mod file, not
+// its full content) are not represented here; only entries describing the
+// module's source zip are kept.
+type GoSumEntry struct {
+	Module  string
+	Version string
+	Hash    string
+}
+
+// parseGoSum parses the contents of a go.sum file, keeping only the entries
+// that hash a module's zip (as opposed to the entries that hash a bare
+// go.mod file, which are suffixed with "/go.mod" and aren't useful here).
+func parseGoSum(content []byte) ([]GoSumEntry, error) {
+	var entries []GoSumEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed go.sum line: %q", line)
+		}
+		module, version, hash := fields[0], fields[1], fields[2]
+		if strings.HasSuffix(version, "/go.mod") {
+			continue
+		}
+		entries = append(entries, GoSumEntry{Module: module, Version: version, Hash: hash})
+	}
+	return entries, nil
+}
+
+// escapeModulePath applies the Go module proxy's escaping convention to a
+// module path or version: every uppercase letter is replaced with an
+// exclamation mark followed by its lowercase equivalent, since module
+// proxies are commonly served from case-insensitive file systems.
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('!')
+			b.WriteRune(r - 'A' + 'a')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// hashZip computes the go.sum "h1:" dirhash of a module zip, matching
+// golang.org/x/mod/sumdb/dirhash.Hash1: the sha256 of each file in the
+// archive, visited in name order (not line order, since the hash prefix of
+// the formatted line would otherwise dominate the sort), hashed together.
+func hashZip(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	files := make([]*zip.File, len(zr.File))
+	copy(files, zr.File)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	h := sha256.New()
+	for _, f := range files {
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", fh.Sum(nil), f.Name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// goproxyZipTarball downloads a module's zip from the Go module proxy
+// protocol (GET $GOPROXY/<escaped-module>/@v/<escaped-version>.zip),
+// recomputes its sha256 for the go_repository rule, and, unless
+// GONOSUMCHECK is set, verifies the downloaded zip against the hash
+// recorded in go.sum.
+func goproxyZipTarball(goproxy string, entry GoSumEntry) (*RemoteTarball, error) {
+	// Cached by module+version alone, not by which proxy produced the entry,
+	// so a module resolved once stays resolvable under any GOPROXY value
+	// (including "off") as long as the cache is warm.
+	if cached, ok := cacheLoad(entry.Module, entry.Version); ok {
+		return &RemoteTarball{url: cached.URL, stripPrefix: cached.StripPrefix, sha256: cached.Sha256}, nil
+	}
+
+	if goproxy == "off" {
+		return nil, fmt.Errorf("GOPROXY=off and no cached entry for %v@%v", entry.Module, entry.Version)
+	}
+
+	url := fmt.Sprintf("%v/%v/@v/%v.zip", goproxy, escapeModulePath(entry.Module), escapeModulePath(entry.Version))
+
+	resp, err := httpGet(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("GONOSUMCHECK") == "" {
+		sum, err := hashZip(data)
+		if err != nil {
+			return nil, fmt.Errorf("hashing %v@%v: %v", entry.Module, entry.Version, err)
+		}
+		if sum != entry.Hash {
+			return nil, fmt.Errorf("checksum mismatch for %v@%v: go.sum has %v, downloaded zip has %v", entry.Module, entry.Version, entry.Hash, sum)
+		}
+	}
+
+	tarball := &RemoteTarball{
+		url:         url,
+		stripPrefix: fmt.Sprintf("%v@%v", entry.Module, entry.Version),
+		sha256:      fmt.Sprintf("%x", sha256.Sum256(data)),
+	}
+	cacheStore(entry.Module, entry.Version, cacheEntry{URL: tarball.url, StripPrefix: tarball.stripPrefix, Sha256: tarball.sha256})
+	return tarball, nil
+}
+
+// cacheEntry is the on-disk representation of a resolved repository,
+// keyed by (url, revision) so that repeated runs can skip network I/O.
+type cacheEntry struct {
+	URL         string `json:"url"`
+	StripPrefix string `json:"strip_prefix"`
+	Sha256      string `json:"sha256"`
+}
+
+// cacheDir returns the directory dep2bazel caches resolved repositories in,
+// or "" if no usable cache directory could be determined.
+func cacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return path.Join(dir, "dep2bazel")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".cache", "dep2bazel")
+}
+
+func cacheFile(url string, revision string) string {
+	key := sha256.Sum256([]byte(url + "@" + revision))
+	return path.Join(cacheDir(), fmt.Sprintf("%x.json", key))
+}
+
+func cacheLoad(url string, revision string) (*cacheEntry, bool) {
+	if cacheDir() == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(cacheFile(url, revision))
+	if err != nil {
+		return nil, false
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func cacheStore(url string, revision string, entry cacheEntry) {
+	dir := cacheDir()
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	ioutil.WriteFile(cacheFile(url, revision), data, 0644)
+}
+
+// gitlabTokenHost is the host GITLAB_TOKEN is sent to, kept in sync with
+// the -gitlab-host flag so that self-hosted GitLab instances can also
+// authenticate with it.
+var gitlabTokenHost = "gitlab.com"
+
+// urlHost extracts the host from a "https://host/path..." URL without
+// pulling in net/url, since "url" is already used as a parameter name
+// throughout this file.
+func urlHost(rawurl string) string {
+	rest := strings.TrimPrefix(rawurl, "https://")
+	rest = strings.TrimPrefix(rest, "http://")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return rest[:i]
+	}
+	return rest
+}
+
+// readNetrc looks up a host's login/password in ~/.netrc, the format
+// understood by curl and other classic Unix tools. Only the "machine",
+// "login" and "password" tokens are recognized; "default" and "macdef"
+// stanzas are ignored.
+func readNetrc(host string) (login string, password string, ok bool) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", false
+	}
+	content, err := ioutil.ReadFile(path.Join(home, ".netrc"))
+	if err != nil {
+		return "", "", false
+	}
+
+	fields := strings.Fields(string(content))
+	var machine string
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if machine == host && login != "" && password != "" {
+				return login, password, true
+			}
+			machine, login, password = fields[i+1], "", ""
+			i++
+		case "default":
+			if machine == host && login != "" && password != "" {
+				return login, password, true
+			}
+			machine, login, password = "", "", ""
+		case "login":
+			login = fields[i+1]
+			i++
+		case "password":
+			password = fields[i+1]
+			i++
+		}
+	}
+	if machine == host && login != "" && password != "" {
+		return login, password, true
+	}
+	return "", "", false
+}
+
+// gitCredentialFill shells out to `git credential fill` to ask whatever
+// credential helper the user has configured (keychain, manager, etc.) for a
+// host's login/password.
+func gitCredentialFill(host string) (login string, password string, ok bool) {
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%v\n\n", host))
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if v := strings.TrimPrefix(line, "username="); v != line {
+			login = v
+		} else if v := strings.TrimPrefix(line, "password="); v != line {
+			password = v
+		}
+	}
+	return login, password, login != "" && password != ""
+}
+
+// authHeader is the memoized result of resolving credentials for a host.
+type authHeader struct {
+	name  string
+	value string
+	ok    bool
+}
+
+var (
+	authHeaderCacheMu sync.Mutex
+	authHeaderCache   = map[string]authHeader{}
+)
+
+// authHeaderForHost returns the HTTP header to send for requests to host,
+// preferring a host-specific token (GITHUB_TOKEN/GITLAB_TOKEN) and falling
+// back to ~/.netrc and the user's git credential helper for arbitrary hosts.
+// The result is memoized per host: resolving credentials can shell out to a
+// git credential helper, and a lockfile can reference the same host hundreds
+// of times.
+func authHeaderForHost(host string) (name string, value string, ok bool) {
+	authHeaderCacheMu.Lock()
+	if cached, found := authHeaderCache[host]; found {
+		authHeaderCacheMu.Unlock()
+		return cached.name, cached.value, cached.ok
+	}
+	authHeaderCacheMu.Unlock()
+
+	name, value, ok = resolveAuthHeaderForHost(host)
+
+	authHeaderCacheMu.Lock()
+	authHeaderCache[host] = authHeader{name: name, value: value, ok: ok}
+	authHeaderCacheMu.Unlock()
+
+	return name, value, ok
+}
+
+func resolveAuthHeaderForHost(host string) (name string, value string, ok bool) {
+	switch host {
+	case "github.com":
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			return "Authorization", "token " + token, true
+		}
+	case gitlabTokenHost:
+		if token := os.Getenv("GITLAB_TOKEN"); token != "" {
+			return "PRIVATE-TOKEN", token, true
+		}
+	}
+	if login, password, ok := readNetrc(host); ok {
+		return "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(login+":"+password)), true
+	}
+	if login, password, ok := gitCredentialFill(host); ok {
+		return "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(login+":"+password)), true
+	}
+	return "", "", false
+}
+
+// httpGet is a drop-in replacement for http.Get that authenticates the
+// request if credentials are configured for the target host.
+func httpGet(rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if name, value, ok := authHeaderForHost(urlHost(rawurl)); ok {
+		req.Header.Set(name, value)
+	}
+	return http.DefaultClient.Do(req)
+}
+
 type RemoteTarball struct {
 	url         string
 	stripPrefix string
@@ -44,19 +389,54 @@ type RemoteGitRepo struct {
 	revision string
 }
 
+// RemoteRepository is a resolved dependency: either a tarball (*RemoteTarball)
+// or, as a fallback, a plain git checkout (*RemoteGitRepo). Rendering it into
+// a Bazel rule is the job of a RuleEmitter, not of RemoteRepository itself.
 type RemoteRepository interface {
-	GetRepoString(name string, importPath string) string
+	isRemoteRepository()
 }
 
-func downloadFile(f *os.File, url string) (err error) {
-	resp, err := http.Get(url)
+func (*RemoteTarball) isRemoteRepository() {}
+func (*RemoteGitRepo) isRemoteRepository() {}
+
+// hashTarGz streams r, computing the sha256 of the raw (gzipped) bytes
+// while, in the same pass, reading through a gzip+tar layer to determine
+// the name of the archive's top-level directory (its strip_prefix). This
+// keeps peak memory at a small constant instead of buffering the whole
+// tarball, and avoids a temp-file round-trip.
+func hashTarGz(r io.Reader) (stripPrefix string, sha string, err error) {
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+
+	gzf, err := gzip.NewReader(tee)
 	if err != nil {
-		return err
+		return "", "", err
+	}
+	tarReader := tar.NewReader(gzf)
+
+	// The first entry is normally the root directory. GitHub codeload
+	// archives are the exception: they stamp a synthetic pax global header
+	// entry first, so the root directory is the entry after that. git
+	// archive-style exports (GitLab, Bitbucket) have no such entry.
+	head, err := tarReader.Next()
+	if err != nil {
+		return "", "", err
+	}
+	if head.Typeflag == tar.TypeXGlobalHeader || head.Name == "pax_global_header" {
+		head, err = tarReader.Next()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	stripPrefix = head.Name
+
+	// Drain whatever is left so the hash covers the whole response body,
+	// not just the bytes gzip/tar needed to read to find stripPrefix.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return "", "", err
 	}
-	defer resp.Body.Close()
 
-	_, err = io.Copy(f, resp.Body)
-	return err
+	return stripPrefix, fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
 // github.com/scele/dep2bazel => com_github_scele_dep2bazel
@@ -73,49 +453,31 @@ func bazelName(importpath string) string {
 }
 
 func githubTarball(url string, revision string) (*RemoteTarball, error) {
-
 	tarball := fmt.Sprintf("%v.tar.gz", revision)
-	f, err := ioutil.TempFile("", "")
-	if err != nil {
-		return nil, err
-	}
-	filename := f.Name()
-	defer os.Remove(filename)
-
 	downloadURL := fmt.Sprintf("%v/archive/%v", url, tarball)
-	err = downloadFile(f, downloadURL)
+
+	// Fetched anonymously: this is a probe for a public, sha256-verifiable
+	// tarball. A repo that actually needs auth will 401/403/404 here, and
+	// remoteRepository falls back to a git checkout (with credentials) in
+	// that case, rather than us silently using ambient credentials to fetch
+	// a tarball URL that a plain "bazel build" could never re-fetch.
+	resp, err := http.Get(downloadURL)
 	if err != nil {
 		return nil, err
 	}
-	f.Close()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", downloadURL, resp.Status)
+	}
 
 	// Github tarballs have one top-level directory that we want to strip out.
 	// Determine the name of that directory by inspecting the tarball.
 	// Usually the directory name is just importname-revision, but we can't assume
 	// it since capitalization might differ.
-	b, err := ioutil.ReadFile(filename)
+	stripPrefix, sha, err := hashTarGz(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	gzf, err := gzip.NewReader(bytes.NewReader(b))
-	if err != nil {
-		return nil, err
-	}
-	tarReader := tar.NewReader(gzf)
-
-	// The root directory is the second entry in the tarball.
-	head, err := tarReader.Next()
-	if err != nil {
-		return nil, err
-	}
-	head, err = tarReader.Next()
-	if err != nil {
-		return nil, err
-	}
-	stripPrefix := head.Name
-
-	// Also compute checksum for the downloaded file.
-	sha := fmt.Sprintf("%x", sha256.Sum256(b))
 
 	return &RemoteTarball{
 		url:         downloadURL,
@@ -168,57 +530,294 @@ func remapURL(url string) string {
 	return url
 }
 
-func tryTarball(url string, revision string) (*RemoteTarball, error) {
-	if strings.HasPrefix(url, "https://github.com/") {
-		return githubTarball(url, revision)
-	} else if strings.HasPrefix(url, "https://go.googlesource.com/") {
-		return googlesourceTarball(url, revision)
-	} else {
-		return &RemoteTarball{}, fmt.Errorf("Unknown server")
+// hostBackend knows how to turn a repository URL and revision into a
+// downloadable tarball for one forge (or family of forges). New forges are
+// added by implementing this interface and registering an instance, rather
+// than editing tryTarball.
+type hostBackend interface {
+	Match(url string) bool
+	Resolve(url string, revision string) (*RemoteTarball, error)
+}
+
+type githubBackend struct{}
+
+func (githubBackend) Match(url string) bool { return strings.HasPrefix(url, "https://github.com/") }
+func (githubBackend) Resolve(url string, revision string) (*RemoteTarball, error) {
+	return githubTarball(url, revision)
+}
+
+type googlesourceBackend struct{}
+
+func (googlesourceBackend) Match(url string) bool {
+	return strings.HasPrefix(url, "https://go.googlesource.com/")
+}
+func (googlesourceBackend) Resolve(url string, revision string) (*RemoteTarball, error) {
+	return googlesourceTarball(url, revision)
+}
+
+// gitlabBackend resolves tarballs from gitlab.com or a self-hosted GitLab
+// instance (configured via -gitlab-host), using GitLab's source archive
+// endpoint: https://<host>/<owner>/<repo>/-/archive/<rev>/<repo>-<rev>.tar.gz
+type gitlabBackend struct {
+	host string
+}
+
+func (b gitlabBackend) Match(url string) bool {
+	return strings.HasPrefix(url, "https://"+b.host+"/")
+}
+
+func (b gitlabBackend) downloadURL(url string, revision string) string {
+	_, repoName := path.Split(url)
+	return fmt.Sprintf("%v/-/archive/%v/%v-%v.tar.gz", url, revision, repoName, revision)
+}
+
+func (b gitlabBackend) Resolve(url string, revision string) (*RemoteTarball, error) {
+	return streamedTarball(b.downloadURL(url, revision))
+}
+
+// bitbucketBackend resolves tarballs from bitbucket.org, using Bitbucket's
+// archive endpoint: https://bitbucket.org/<owner>/<repo>/get/<rev>.tar.gz
+type bitbucketBackend struct{}
+
+func (bitbucketBackend) Match(url string) bool {
+	return strings.HasPrefix(url, "https://bitbucket.org/")
+}
+
+func (bitbucketBackend) downloadURL(url string, revision string) string {
+	return fmt.Sprintf("%v/get/%v.tar.gz", url, revision)
+}
+
+func (b bitbucketBackend) Resolve(url string, revision string) (*RemoteTarball, error) {
+	return streamedTarball(b.downloadURL(url, revision))
+}
+
+// streamedTarball downloads downloadURL and streams it through hashTarGz to
+// determine its strip_prefix and sha256, the way githubTarball does. Fetched
+// anonymously, like githubTarball: see the comment there for why.
+func streamedTarball(downloadURL string) (*RemoteTarball, error) {
+	resp, err := http.Get(downloadURL)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", downloadURL, resp.Status)
+	}
+
+	stripPrefix, sha, err := hashTarGz(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteTarball{url: downloadURL, stripPrefix: stripPrefix, sha256: sha}, nil
+}
+
+// templateBackend is a user-configured backend, loaded from a JSON config
+// file mapping a host pattern to a URL template. {url} and {revision} are
+// substituted with the repository URL and the locked revision. If
+// StripPrefixTemplate is empty, the strip_prefix is instead detected by
+// inspecting the downloaded tarball, as with the built-in backends.
+type templateBackend struct {
+	HostPrefix          string `json:"host_prefix"`
+	URLTemplate         string `json:"url_template"`
+	StripPrefixTemplate string `json:"strip_prefix_template,omitempty"`
 }
 
-// GetRepoString returns the go_repository rule string.
-func (t *RemoteTarball) GetRepoString(name string, importPath string) string {
-	str := fmt.Sprintf("\n")
-	str += fmt.Sprintf("    go_repository(\n")
-	str += fmt.Sprintf("        name = \"%v\",\n", name)
-	str += fmt.Sprintf("        importpath = \"%v\",\n", importPath)
-	str += fmt.Sprintf("        urls = [\"%v\"],\n", t.url)
-	str += fmt.Sprintf("        strip_prefix = \"%v\",\n", t.stripPrefix)
-	if t.sha256 != "" {
-		str += fmt.Sprintf("        sha256 = \"%v\",\n", t.sha256)
+func (b templateBackend) Match(url string) bool { return strings.HasPrefix(url, b.HostPrefix) }
+
+// render substitutes {url} and {revision} into the backend's templates,
+// returning the download URL and, if configured, the strip_prefix.
+func (b templateBackend) render(url string, revision string) (downloadURL string, stripPrefix string) {
+	replacer := strings.NewReplacer("{url}", url, "{revision}", revision)
+	downloadURL = replacer.Replace(b.URLTemplate)
+	if b.StripPrefixTemplate != "" {
+		stripPrefix = replacer.Replace(b.StripPrefixTemplate)
 	}
-	str += fmt.Sprintf("        build_file_proto_mode = \"disable\",\n")
-	str += fmt.Sprintf("    )\n")
-	return str
+	return downloadURL, stripPrefix
 }
 
-// GetRepoString returns the go_repository rule string.
-func (t *RemoteGitRepo) GetRepoString(name string, importPath string) string {
-	str := fmt.Sprintf("\n")
-	str += fmt.Sprintf("    go_repository(\n")
-	str += fmt.Sprintf("        name = \"%v\",\n", name)
-	str += fmt.Sprintf("        importpath = \"%v\",\n", importPath)
-	str += fmt.Sprintf("        commit = \"%v\",\n", t.revision)
-	str += fmt.Sprintf("        build_file_proto_mode = \"disable\",\n")
-	str += fmt.Sprintf("    )\n")
-	return str
+func (b templateBackend) Resolve(url string, revision string) (*RemoteTarball, error) {
+	downloadURL, stripPrefix := b.render(url, revision)
+	if stripPrefix == "" {
+		return streamedTarball(downloadURL)
+	}
+
+	// Fetched anonymously, like streamedTarball: see the comment on
+	// githubTarball for why.
+	resp, err := http.Get(downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", downloadURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteTarball{
+		url:         downloadURL,
+		stripPrefix: stripPrefix,
+		sha256:      fmt.Sprintf("%x", sha256.Sum256(data)),
+	}, nil
+}
+
+// loadBackendsConfig reads a JSON file containing a list of templateBackend
+// entries, for forges the built-in backends don't cover.
+func loadBackendsConfig(filename string) ([]hostBackend, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var configs []templateBackend
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, err
+	}
+	backends := make([]hostBackend, len(configs))
+	for i, c := range configs {
+		backends[i] = c
+	}
+	return backends, nil
+}
+
+// defaultBackends returns the built-in host backends, in the order they
+// should be tried.
+func defaultBackends(gitlabHost string) []hostBackend {
+	return []hostBackend{
+		githubBackend{},
+		googlesourceBackend{},
+		gitlabBackend{host: gitlabHost},
+		bitbucketBackend{},
+	}
 }
 
-func remoteRepository(url string, importName string, revision string) (RemoteRepository, error) {
+func tryTarball(backends []hostBackend, url string, revision string) (*RemoteTarball, error) {
+	for _, b := range backends {
+		if b.Match(url) {
+			return b.Resolve(url, revision)
+		}
+	}
+	return nil, fmt.Errorf("Unknown server")
+}
+
+// ruleOptions carries the gazelle/go_repository knobs that are constant
+// across a single dep2bazel invocation (set from flags), as opposed to the
+// per-dependency data carried by a RemoteRepository.
+type ruleOptions struct {
+	protoMode           string
+	buildFileGeneration string
+	buildTags           []string
+	patches             []string
+	patchArgs           []string
+}
+
+// RuleEmitter renders a resolved RemoteRepository into a Bazel rule string.
+// Keeping this separate from RemoteRepository lets new rule flavors (e.g. a
+// plain http_archive, or a future git_repository-only emitter) be added
+// without touching the resolution code above.
+type RuleEmitter interface {
+	Emit(repo RemoteRepository, name string, importPath string, opts ruleOptions) (string, error)
+}
+
+// goRepositoryEmitter emits gazelle's go_repository rule, the historical
+// (and default) output format of dep2bazel.
+type goRepositoryEmitter struct{}
+
+func (goRepositoryEmitter) Emit(repo RemoteRepository, name string, importPath string, opts ruleOptions) (string, error) {
+	var b strings.Builder
+	b.WriteString("\n    go_repository(\n")
+	fmt.Fprintf(&b, "        name = %q,\n", name)
+	fmt.Fprintf(&b, "        importpath = %q,\n", importPath)
+
+	switch r := repo.(type) {
+	case *RemoteTarball:
+		fmt.Fprintf(&b, "        urls = [%q],\n", r.url)
+		fmt.Fprintf(&b, "        strip_prefix = %q,\n", r.stripPrefix)
+		if r.sha256 != "" {
+			fmt.Fprintf(&b, "        sha256 = %q,\n", r.sha256)
+		}
+	case *RemoteGitRepo:
+		fmt.Fprintf(&b, "        commit = %q,\n", r.revision)
+	default:
+		return "", fmt.Errorf("go_repository: unsupported repository type %T", repo)
+	}
+
+	writeCommonAttrs(&b, opts)
+	b.WriteString("    )\n")
+	return b.String(), nil
+}
+
+// httpArchiveEmitter emits a plain http_archive rule, for consumers that
+// don't use rules_go/gazelle. It only supports repositories resolved to a
+// tarball, since http_archive has no equivalent of a bare git checkout.
+type httpArchiveEmitter struct{}
+
+func (httpArchiveEmitter) Emit(repo RemoteRepository, name string, importPath string, opts ruleOptions) (string, error) {
+	tarball, ok := repo.(*RemoteTarball)
+	if !ok {
+		return "", fmt.Errorf("http_archive: %v has no tarball to fetch (it fell back to a git checkout)", importPath)
+	}
+
+	var b strings.Builder
+	b.WriteString("\n    http_archive(\n")
+	fmt.Fprintf(&b, "        name = %q,\n", name)
+	fmt.Fprintf(&b, "        urls = [%q],\n", tarball.url)
+	fmt.Fprintf(&b, "        strip_prefix = %q,\n", tarball.stripPrefix)
+	if tarball.sha256 != "" {
+		fmt.Fprintf(&b, "        sha256 = %q,\n", tarball.sha256)
+	}
+	b.WriteString("    )\n")
+	return b.String(), nil
+}
+
+// writeCommonAttrs appends the go_repository attributes driven by ruleOptions
+// (proto mode, build file generation, build tags, patches) shared by every
+// RemoteRepository kind.
+func writeCommonAttrs(b *strings.Builder, opts ruleOptions) {
+	protoMode := opts.protoMode
+	if protoMode == "" {
+		protoMode = "disable"
+	}
+	fmt.Fprintf(b, "        build_file_proto_mode = %q,\n", protoMode)
+
+	if opts.buildFileGeneration != "" {
+		fmt.Fprintf(b, "        build_file_generation = %q,\n", opts.buildFileGeneration)
+	}
+	if len(opts.buildTags) > 0 {
+		fmt.Fprintf(b, "        build_tags = [%v],\n", quotedList(opts.buildTags))
+	}
+	if len(opts.patches) > 0 {
+		fmt.Fprintf(b, "        patches = [%v],\n", quotedList(opts.patches))
+	}
+	if len(opts.patchArgs) > 0 {
+		fmt.Fprintf(b, "        patch_args = [%v],\n", quotedList(opts.patchArgs))
+	}
+}
+
+func quotedList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = fmt.Sprintf("%q", item)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func remoteRepository(backends []hostBackend, url string, importName string, revision string) (RemoteRepository, error) {
+
+	if cached, ok := cacheLoad(url, revision); ok {
+		return &RemoteTarball{url: cached.URL, stripPrefix: cached.StripPrefix, sha256: cached.Sha256}, nil
+	}
 
 	remappedURL := remapURL(url)
 
 	// First, try downloading a tarball using our remapped url.
-	tarball, err := tryTarball(remappedURL, revision)
-	if err == nil {
-		return tarball, nil
+	tarball, err := tryTarball(backends, remappedURL, revision)
+	if err != nil {
+		// Then, try downloading a tarball using the original url.
+		tarball, err = tryTarball(backends, url, revision)
 	}
-
-	// Then, try downloading a tarball using the original url.
-	tarball, err = tryTarball(url, revision)
 	if err == nil {
+		cacheStore(url, revision, cacheEntry{URL: tarball.url, StripPrefix: tarball.stripPrefix, Sha256: tarball.sha256})
 		return tarball, nil
 	}
 
@@ -226,63 +825,211 @@ func remoteRepository(url string, importName string, revision string) (RemoteRep
 	return &RemoteGitRepo{revision: revision}, nil
 }
 
-const repoTemplateNoChecksum = `
-    go_repository(
-        name = "%v",
-        importpath = "%v",
-        urls = ["%v"],
-        strip_prefix = "%v",
-        build_file_proto_mode = "disable",
-    )
-`
-
 func usage() {
-	fmt.Println("usage: dep2bazel path/to/Gopkg.lock")
+	fmt.Println("usage: dep2bazel [flags] path/to/Gopkg.lock")
+	fmt.Println("       dep2bazel [flags] path/to/go.mod  (go.sum must live alongside it)")
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
-func main() {
-	if len(os.Args) != 2 {
-		usage()
+func printHeader(format string) {
+	fmt.Printf("# This file is autogenerated with dep2bazel, do not edit.\n")
+	switch format {
+	case "http_archive":
+		fmt.Printf("load(\"@bazel_tools//tools/build_defs/repo:http.bzl\", \"http_archive\")\n")
+	default:
+		fmt.Printf("load(\"@io_bazel_rules_go//go:def.bzl\", \"go_repository\")\n")
 	}
+	fmt.Printf("\ndef go_deps():\n")
+}
 
-	filename := strings.TrimSpace(os.Args[1])
-	if filename == "" {
-		usage()
+// poolResult holds the outcome of resolving a single item in a worker pool:
+// either the rule string to print on stdout, or the message to print on
+// stderr if resolution failed.
+type poolResult struct {
+	out string
+	err string
+}
+
+// runPool resolves n items concurrently, bounded to jobs workers at a time,
+// and returns their results in input order so that output stays
+// deterministic regardless of which goroutine finishes first.
+func runPool(n int, jobs int, resolve func(i int) poolResult) []poolResult {
+	results := make([]poolResult, n)
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = resolve(i)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func printResults(results []poolResult) {
+	for _, r := range results {
+		if r.err != "" {
+			fmt.Fprintln(os.Stderr, r.err)
+		} else {
+			fmt.Print(r.out)
+		}
 	}
+}
 
+// runDepLock generates rules from a dep Gopkg.lock file.
+func runDepLock(filename string, jobs int, backends []hostBackend, format string, emitter RuleEmitter, opts ruleOptions) error {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to read Gopkg.lock", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to read Gopkg.lock: %v", err)
 	}
 
 	raw := Lock{}
-	err = toml.Unmarshal(content, &raw)
+	if err := toml.Unmarshal(content, &raw); err != nil {
+		return fmt.Errorf("failed to parse Gopkg.lock: %v", err)
+	}
+
+	printHeader(format)
+
+	results := runPool(len(raw.Projects), jobs, func(i int) poolResult {
+		lp := raw.Projects[i]
+		root, err := vcs.RepoRootForImportPath(lp.Name, false)
+		if err != nil {
+			return poolResult{err: err.Error()}
+		}
+		repo, err := remoteRepository(backends, root.Repo, lp.Name, lp.Revision)
+		if err != nil {
+			return poolResult{err: fmt.Sprintf("failed to parse %v (%v@%v): %v", lp.Name, root.Repo, lp.Revision, err)}
+		}
+		rule, err := emitter.Emit(repo, bazelName(lp.Name), lp.Name, opts)
+		if err != nil {
+			return poolResult{err: fmt.Sprintf("failed to emit rule for %v: %v", lp.Name, err)}
+		}
+		return poolResult{out: rule}
+	})
+	printResults(results)
+	return nil
+}
+
+// runGoModules generates rules from a go.mod/go.sum pair, resolving each
+// module's zip through the Go module proxy protocol.
+func runGoModules(goproxy string, filename string, jobs int, format string, emitter RuleEmitter, opts ruleOptions) error {
+	sumFilename := path.Join(path.Dir(filename), "go.sum")
+	content, err := ioutil.ReadFile(sumFilename)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to parse Gopkg.lock", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to read %v: %v", sumFilename, err)
 	}
 
-	fmt.Printf(`# This file is autogenerated with dep2bazel, do not edit.
-load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+	entries, err := parseGoSum(content)
+	if err != nil {
+		return fmt.Errorf("failed to parse %v: %v", sumFilename, err)
+	}
 
-def go_deps():
-`)
+	printHeader(format)
 
-	for _, lp := range raw.Projects {
-		root, err := vcs.RepoRootForImportPath(lp.Name, false)
+	results := runPool(len(entries), jobs, func(i int) poolResult {
+		entry := entries[i]
+		repo, err := goproxyZipTarball(goproxy, entry)
 		if err != nil {
-			fmt.Println(err)
-			continue
+			return poolResult{err: fmt.Sprintf("failed to resolve %v@%v: %v", entry.Module, entry.Version, err)}
 		}
-		importpath := lp.Name
-		repo, err := remoteRepository(root.Repo, lp.Name, lp.Revision)
+		rule, err := emitter.Emit(repo, bazelName(entry.Module), entry.Module, opts)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to parse %v (%v@%v): %v\n", lp.Name, root.Repo, lp.Revision, err)
-		} else {
-			fmt.Print(repo.GetRepoString(bazelName(importpath), importpath))
+			return poolResult{err: fmt.Sprintf("failed to emit rule for %v: %v", entry.Module, err)}
 		}
+		return poolResult{out: rule}
+	})
+	printResults(results)
+	return nil
+}
+
+// repeatedFlag collects the values of a flag passed more than once, e.g.
+// -patch a.patch -patch b.patch.
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string { return strings.Join(*f, ",") }
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func main() {
+	jobs := flag.Int("j", runtime.NumCPU(), "number of repositories to resolve concurrently")
+	gitlabHost := flag.String("gitlab-host", "gitlab.com", "host to treat as a GitLab instance")
+	backendsConfig := flag.String("backends-config", "", "path to a JSON file of additional host backends")
+	format := flag.String("format", "go_repository", "rule format to emit: go_repository or http_archive")
+	protoMode := flag.String("proto-mode", "disable", "build_file_proto_mode for go_repository")
+	buildFileGeneration := flag.String("build-file-generation", "", "build_file_generation for go_repository (e.g. \"on\"); omitted if empty")
+	buildTags := flag.String("build-tags", "", "comma-separated build_tags for go_repository")
+	var patches repeatedFlag
+	flag.Var(&patches, "patch", "patch file to apply to the repository (may be repeated)")
+	var patchArgs repeatedFlag
+	flag.Var(&patchArgs, "patch-args", "arguments to pass to the patch tool (may be repeated)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		usage()
+	}
+
+	filename := strings.TrimSpace(flag.Arg(0))
+	if filename == "" {
+		usage()
 	}
 
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	goproxy := os.Getenv("GOPROXY")
+	if goproxy == "" {
+		goproxy = "https://proxy.golang.org"
+	}
+
+	gitlabTokenHost = *gitlabHost
+	backends := defaultBackends(*gitlabHost)
+	if *backendsConfig != "" {
+		custom, err := loadBackendsConfig(*backendsConfig)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to load -backends-config:", err)
+			os.Exit(1)
+		}
+		backends = append(custom, backends...)
+	}
+
+	var emitter RuleEmitter
+	switch *format {
+	case "go_repository":
+		emitter = goRepositoryEmitter{}
+	case "http_archive":
+		emitter = httpArchiveEmitter{}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -format %q: must be \"go_repository\" or \"http_archive\"\n", *format)
+		os.Exit(1)
+	}
+
+	opts := ruleOptions{
+		protoMode:           *protoMode,
+		buildFileGeneration: *buildFileGeneration,
+		patches:             patches,
+		patchArgs:           patchArgs,
+	}
+	if *buildTags != "" {
+		opts.buildTags = strings.Split(*buildTags, ",")
+	}
+
+	var err error
+	if path.Base(filename) == "go.mod" {
+		err = runGoModules(goproxy, filename, *jobs, *format, emitter, opts)
+	} else {
+		err = runDepLock(filename, *jobs, backends, *format, emitter, opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// buildTarGz builds an in-memory tar.gz archive shaped like a GitHub
+// codeload archive (withPaxHeader=true: a pax global header entry, then the
+// top-level directory entry, then a file inside it) or like a git
+// archive-style export from GitLab/Bitbucket (withPaxHeader=false: no
+// leading pax entry, the top-level directory comes first).
+func buildTarGz(t *testing.T, dirName string, withPaxHeader bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	type tarEntry struct {
+		name string
+		body string
+	}
+	var entries []tarEntry
+	if withPaxHeader {
+		entries = append(entries, tarEntry{"pax_global_header", ""})
+	}
+	entries = append(entries,
+		tarEntry{dirName + "/", ""},
+		tarEntry{dirName + "/README.md", "hello\n"},
+	)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Size: int64(len(e.body))}
+		if strings.HasSuffix(e.name, "/") {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%v): %v", e.name, err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("Write(%v): %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("gzip Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHashTarGz(t *testing.T) {
+	data := buildTarGz(t, "dep2bazel-deadbeef", true)
+
+	stripPrefix, sha, err := hashTarGz(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("hashTarGz: %v", err)
+	}
+
+	if want := "dep2bazel-deadbeef/"; stripPrefix != want {
+		t.Errorf("stripPrefix = %q, want %q", stripPrefix, want)
+	}
+
+	if want := fmt.Sprintf("%x", sha256.Sum256(data)); sha != want {
+		t.Errorf("sha256 = %q, want %q", sha, want)
+	}
+}
+
+func TestHashTarGzGitArchiveStyle(t *testing.T) {
+	// GitLab's and Bitbucket's archive endpoints produce git archive-style
+	// tarballs with no leading pax global header entry: the first entry is
+	// already the root directory.
+	data := buildTarGz(t, "dep2bazel-deadbeef", false)
+
+	stripPrefix, sha, err := hashTarGz(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("hashTarGz: %v", err)
+	}
+
+	if want := "dep2bazel-deadbeef/"; stripPrefix != want {
+		t.Errorf("stripPrefix = %q, want %q", stripPrefix, want)
+	}
+
+	if want := fmt.Sprintf("%x", sha256.Sum256(data)); sha != want {
+		t.Errorf("sha256 = %q, want %q", sha, want)
+	}
+}
+
+func TestParseGoSum(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []GoSumEntry
+		wantErr bool
+	}{
+		{
+			name:    "zip and go.mod entries, go.mod entries dropped",
+			content: "github.com/pkg/errors v0.9.1 h1:FEBLx1zS214owpjy7qsBeixbURkuhQAwrK5UwLGTwt4=\ngithub.com/pkg/errors v0.9.1/go.mod h1:bwawxfHBFNV+L2hUp1rHADufV3IMtnDRdf1r5NINEl0=\n",
+			want: []GoSumEntry{
+				{Module: "github.com/pkg/errors", Version: "v0.9.1", Hash: "h1:FEBLx1zS214owpjy7qsBeixbURkuhQAwrK5UwLGTwt4="},
+			},
+		},
+		{
+			name:    "blank lines ignored",
+			content: "\n\ngithub.com/pkg/errors v0.9.1 h1:FEBLx1zS214owpjy7qsBeixbURkuhQAwrK5UwLGTwt4=\n\n",
+			want: []GoSumEntry{
+				{Module: "github.com/pkg/errors", Version: "v0.9.1", Hash: "h1:FEBLx1zS214owpjy7qsBeixbURkuhQAwrK5UwLGTwt4="},
+			},
+		},
+		{
+			name:    "malformed line",
+			content: "github.com/pkg/errors v0.9.1\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGoSum([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGoSum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseGoSum() = %#v, want %#v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("entry %d = %#v, want %#v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEscapeModulePath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"github.com/pkg/errors", "github.com/pkg/errors"},
+		{"github.com/BurntSushi/toml", "github.com/!burnt!sushi/toml"},
+		{"v1.2.3", "v1.2.3"},
+	}
+	for _, tt := range tests {
+		if got := escapeModulePath(tt.in); got != tt.want {
+			t.Errorf("escapeModulePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHashZip(t *testing.T) {
+	build := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, body := range files {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatalf("Create(%v): %v", name, err)
+			}
+			if _, err := w.Write([]byte(body)); err != nil {
+				t.Fatalf("Write(%v): %v", name, err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("zip Close: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	data := build(map[string]string{
+		"mod@v1.0.0/a.go": "package mod\n",
+		"mod@v1.0.0/b.go": "package mod\n\nconst B = 1\n",
+	})
+
+	sum, err := hashZip(data)
+	if err != nil {
+		t.Fatalf("hashZip: %v", err)
+	}
+	if !strings.HasPrefix(sum, "h1:") {
+		t.Errorf("hashZip() = %q, want h1: prefix", sum)
+	}
+
+	// The hash only depends on file contents and names, not on the order
+	// files were added to the archive.
+	reordered := build(map[string]string{
+		"mod@v1.0.0/b.go": "package mod\n\nconst B = 1\n",
+		"mod@v1.0.0/a.go": "package mod\n",
+	})
+	sum2, err := hashZip(reordered)
+	if err != nil {
+		t.Fatalf("hashZip: %v", err)
+	}
+	if sum != sum2 {
+		t.Errorf("hashZip() is order-dependent: %q != %q", sum, sum2)
+	}
+
+	// Reference vector independently computed with the dirhash Hash1
+	// algorithm (golang.org/x/mod/sumdb/dirhash), which sorts files by name
+	// before hashing: catches hashZip sorting by the formatted "hash  name"
+	// line instead of by name, which happens to still pass the
+	// order-independence check above but produces the wrong digest.
+	reference := build(map[string]string{
+		"example.com/mod@v1.0.0/go.mod":   "module example.com/mod\n\ngo 1.16\n",
+		"example.com/mod@v1.0.0/a.go":     "package mod\n",
+		"example.com/mod@v1.0.0/sub/b.go": "package sub\n\nconst B = 1\n",
+	})
+	got, err := hashZip(reference)
+	if err != nil {
+		t.Fatalf("hashZip: %v", err)
+	}
+	if want := "h1:rGPu8ex7Z5dhl5GC7h6LOXvA8nlOge9kH80QB+tNMfw="; got != want {
+		t.Errorf("hashZip() = %q, want %q (dirhash reference vector)", got, want)
+	}
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep2bazel-cache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_CACHE_HOME", dir)
+
+	if _, ok := cacheLoad("github.com/pkg/errors", "v0.9.1"); ok {
+		t.Fatalf("cacheLoad() found an entry before any cacheStore()")
+	}
+
+	entry := cacheEntry{URL: "https://example.com/mod.zip", StripPrefix: "mod@v0.9.1", Sha256: "deadbeef"}
+	cacheStore("github.com/pkg/errors", "v0.9.1", entry)
+
+	got, ok := cacheLoad("github.com/pkg/errors", "v0.9.1")
+	if !ok {
+		t.Fatalf("cacheLoad() found no entry after cacheStore()")
+	}
+	if *got != entry {
+		t.Errorf("cacheLoad() = %#v, want %#v", *got, entry)
+	}
+
+	// A different module/version pair is a cache miss, regardless of which
+	// proxy would have produced it.
+	if _, ok := cacheLoad("github.com/pkg/other", "v0.9.1"); ok {
+		t.Errorf("cacheLoad() returned an entry for an unrelated module")
+	}
+}
+
+func TestRunPoolPreservesOrder(t *testing.T) {
+	const n = 20
+	for _, jobs := range []int{1, 4} {
+		results := runPool(n, jobs, func(i int) poolResult {
+			return poolResult{out: fmt.Sprintf("%d", i)}
+		})
+		if len(results) != n {
+			t.Fatalf("runPool(jobs=%d) returned %d results, want %d", jobs, len(results), n)
+		}
+		for i, r := range results {
+			if want := fmt.Sprintf("%d", i); r.out != want {
+				t.Errorf("runPool(jobs=%d)[%d].out = %q, want %q", jobs, i, r.out, want)
+			}
+		}
+	}
+}
+
+func TestGitlabBackendDownloadURL(t *testing.T) {
+	b := gitlabBackend{host: "gitlab.com"}
+	got := b.downloadURL("https://gitlab.com/owner/repo", "deadbeef")
+	want := "https://gitlab.com/owner/repo/-/archive/deadbeef/repo-deadbeef.tar.gz"
+	if got != want {
+		t.Errorf("downloadURL() = %q, want %q", got, want)
+	}
+}
+
+func TestBitbucketBackendDownloadURL(t *testing.T) {
+	b := bitbucketBackend{}
+	got := b.downloadURL("https://bitbucket.org/owner/repo", "deadbeef")
+	want := "https://bitbucket.org/owner/repo/get/deadbeef.tar.gz"
+	if got != want {
+		t.Errorf("downloadURL() = %q, want %q", got, want)
+	}
+}
+
+func TestTemplateBackendRender(t *testing.T) {
+	tests := []struct {
+		name            string
+		backend         templateBackend
+		url             string
+		revision        string
+		wantDownloadURL string
+		wantStripPrefix string
+	}{
+		{
+			name:            "no strip_prefix template",
+			backend:         templateBackend{HostPrefix: "https://example.com/", URLTemplate: "{url}/archive/{revision}.tar.gz"},
+			url:             "https://example.com/owner/repo",
+			revision:        "deadbeef",
+			wantDownloadURL: "https://example.com/owner/repo/archive/deadbeef.tar.gz",
+			wantStripPrefix: "",
+		},
+		{
+			name:            "explicit strip_prefix template",
+			backend:         templateBackend{HostPrefix: "https://example.com/", URLTemplate: "{url}/archive/{revision}.tar.gz", StripPrefixTemplate: "repo-{revision}"},
+			url:             "https://example.com/owner/repo",
+			revision:        "deadbeef",
+			wantDownloadURL: "https://example.com/owner/repo/archive/deadbeef.tar.gz",
+			wantStripPrefix: "repo-deadbeef",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotURL, gotStripPrefix := tt.backend.render(tt.url, tt.revision)
+			if gotURL != tt.wantDownloadURL {
+				t.Errorf("render() downloadURL = %q, want %q", gotURL, tt.wantDownloadURL)
+			}
+			if gotStripPrefix != tt.wantStripPrefix {
+				t.Errorf("render() stripPrefix = %q, want %q", gotStripPrefix, tt.wantStripPrefix)
+			}
+		})
+	}
+}
+
+func TestGoRepositoryEmitter(t *testing.T) {
+	out, err := goRepositoryEmitter{}.Emit(
+		&RemoteTarball{url: "https://example.com/mod.zip", stripPrefix: "mod@v1.0.0", sha256: "deadbeef"},
+		"com_github_pkg_errors",
+		"github.com/pkg/errors",
+		ruleOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	for _, want := range []string{
+		`name = "com_github_pkg_errors"`,
+		`importpath = "github.com/pkg/errors"`,
+		`urls = ["https://example.com/mod.zip"]`,
+		`strip_prefix = "mod@v1.0.0"`,
+		`sha256 = "deadbeef"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Emit() output missing %q, got:\n%s", want, out)
+		}
+	}
+
+	out, err = goRepositoryEmitter{}.Emit(
+		&RemoteGitRepo{revision: "deadbeef"},
+		"com_github_pkg_errors",
+		"github.com/pkg/errors",
+		ruleOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	if !strings.Contains(out, `commit = "deadbeef"`) {
+		t.Errorf("Emit() output missing commit attr, got:\n%s", out)
+	}
+}
+
+func TestHTTPArchiveEmitter(t *testing.T) {
+	out, err := httpArchiveEmitter{}.Emit(
+		&RemoteTarball{url: "https://example.com/mod.zip", stripPrefix: "mod@v1.0.0", sha256: "deadbeef"},
+		"com_github_pkg_errors",
+		"github.com/pkg/errors",
+		ruleOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	for _, want := range []string{
+		`name = "com_github_pkg_errors"`,
+		`urls = ["https://example.com/mod.zip"]`,
+		`strip_prefix = "mod@v1.0.0"`,
+		`sha256 = "deadbeef"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Emit() output missing %q, got:\n%s", want, out)
+		}
+	}
+
+	_, err = httpArchiveEmitter{}.Emit(&RemoteGitRepo{revision: "deadbeef"}, "name", "importpath", ruleOptions{})
+	if err == nil {
+		t.Errorf("Emit() with a git-only repository should have errored")
+	}
+}
+
+func TestReadNetrc(t *testing.T) {
+	home, err := ioutil.TempDir("", "dep2bazel-home")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+
+	netrc := "machine example.com login alice password hunter2\nmachine other.com login bob password swordfish\n"
+	if err := ioutil.WriteFile(path.Join(home, ".netrc"), []byte(netrc), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	login, password, ok := readNetrc("example.com")
+	if !ok || login != "alice" || password != "hunter2" {
+		t.Errorf("readNetrc(example.com) = %q, %q, %v, want alice, hunter2, true", login, password, ok)
+	}
+
+	if _, _, ok := readNetrc("unknown.com"); ok {
+		t.Errorf("readNetrc(unknown.com) found an entry that shouldn't exist")
+	}
+}
+
+func TestAuthHeaderForHost(t *testing.T) {
+	home, err := ioutil.TempDir("", "dep2bazel-home")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("GITLAB_TOKEN", "")
+
+	resetAuthHeaderCache := func() {
+		authHeaderCacheMu.Lock()
+		authHeaderCache = map[string]authHeader{}
+		authHeaderCacheMu.Unlock()
+	}
+	resetAuthHeaderCache()
+	defer resetAuthHeaderCache()
+
+	t.Setenv("GITHUB_TOKEN", "ghtoken")
+	name, value, ok := authHeaderForHost("github.com")
+	if !ok || name != "Authorization" || value != "token ghtoken" {
+		t.Errorf("authHeaderForHost(github.com) = %q, %q, %v, want Authorization, \"token ghtoken\", true", name, value, ok)
+	}
+
+	resetAuthHeaderCache()
+
+	oldGitlabTokenHost := gitlabTokenHost
+	gitlabTokenHost = "gitlab.example.com"
+	defer func() { gitlabTokenHost = oldGitlabTokenHost }()
+	t.Setenv("GITLAB_TOKEN", "gltoken")
+	name, value, ok = authHeaderForHost("gitlab.example.com")
+	if !ok || name != "PRIVATE-TOKEN" || value != "gltoken" {
+		t.Errorf("authHeaderForHost(gitlab.example.com) = %q, %q, %v, want PRIVATE-TOKEN, gltoken, true", name, value, ok)
+	}
+
+	// Memoization: a second lookup for the same host returns the cached
+	// result without re-resolving, even after the underlying env var changes.
+	resetAuthHeaderCache()
+	name, value, ok = authHeaderForHost("github.com")
+	t.Setenv("GITHUB_TOKEN", "different")
+	name2, value2, ok2 := authHeaderForHost("github.com")
+	if name != name2 || value != value2 || ok != ok2 {
+		t.Errorf("authHeaderForHost(github.com) changed across calls: (%q, %q, %v) != (%q, %q, %v)", name, value, ok, name2, value2, ok2)
+	}
+}